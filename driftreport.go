@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tajtiattila/gpstimetest/exifwrite"
+)
+
+// driftSample is one calibration point for a camera model's clock drift
+// fit: a GPS-true capture time and how far the camera's own corrected
+// time was from it.
+type driftSample struct {
+	rel   string
+	t     time.Time     // GPSDateTime, i.e. ground truth
+	delta time.Duration // Corrected - GPSDateTime
+}
+
+// driftStat summarizes one camera model's clock behaviour across a batch:
+// the central tendency and spread of Corrected-GPSDateTime deltas, plus a
+// Theil-Sen fit of delta against capture time to catch crystal drift over
+// a multi-day trip.
+type driftStat struct {
+	Model string
+	N     int
+
+	Median, MAD time.Duration
+	Min, Max    time.Duration
+
+	SlopePPM     float64 // drift, in parts per million of elapsed time
+	InterceptSec float64 // fitted offset at the first sample, in seconds
+
+	Outliers []string // rel paths whose fit residual exceeds 3x the residual MAD
+}
+
+// runDriftReport aggregates every photo with both a Corrected and a
+// GPSDateTime by camera Model, reports each model's drift statistics in
+// -report-format, and, with -apply-shift=auto, rewrites DateTimeOriginal
+// for every photo of that model using the detected median offset.
+func runDriftReport(entries []*fileEntry) {
+	calib := map[string][]driftSample{}
+	byModel := map[string][]*fileEntry{}
+	for _, e := range entries {
+		if e.err != nil || e.et.Model == "" || e.et.DateTime.IsZero() {
+			continue
+		}
+		byModel[e.et.Model] = append(byModel[e.et.Model], e)
+		if !e.et.Corrected.IsZero() && !e.et.GPSDateTime.IsZero() {
+			calib[e.et.Model] = append(calib[e.et.Model], driftSample{
+				rel:   e.rel,
+				t:     e.et.GPSDateTime,
+				delta: e.et.Corrected.Sub(e.et.GPSDateTime),
+			})
+		}
+	}
+
+	var models []string
+	for m := range calib {
+		models = append(models, m)
+	}
+	sort.Strings(models)
+
+	stats := make([]driftStat, 0, len(models))
+	for _, m := range models {
+		stats = append(stats, computeDrift(m, calib[m]))
+	}
+
+	switch *reportFormat {
+	case "json":
+		printDriftJSON(stats)
+	case "csv":
+		printDriftCSV(stats)
+	default:
+		printDriftText(stats)
+	}
+
+	switch *applyShift {
+	case "":
+	case "auto":
+		applyShifts(byModel, stats)
+	default:
+		log.Fatalf("-apply-shift: unsupported value %q (want \"auto\")", *applyShift)
+	}
+}
+
+func computeDrift(model string, samples []driftSample) driftStat {
+	n := len(samples)
+	deltaSec := make([]float64, n)
+	for i, s := range samples {
+		deltaSec[i] = s.delta.Seconds()
+	}
+	median := medianFloat(append([]float64(nil), deltaSec...))
+	mad := medianAbsDev(deltaSec, median)
+
+	minD, maxD := samples[0].delta, samples[0].delta
+	for _, s := range samples {
+		if s.delta < minD {
+			minD = s.delta
+		}
+		if s.delta > maxD {
+			maxD = s.delta
+		}
+	}
+
+	t0 := samples[0].t
+	elapsedSec := make([]float64, n)
+	for i, s := range samples {
+		elapsedSec[i] = s.t.Sub(t0).Seconds()
+	}
+	slope, intercept := theilSen(elapsedSec, deltaSec)
+
+	resid := make([]float64, n)
+	for i := range elapsedSec {
+		resid[i] = deltaSec[i] - (slope*elapsedSec[i] + intercept)
+	}
+	residMedian := medianFloat(append([]float64(nil), resid...))
+	residMAD := medianAbsDev(resid, residMedian)
+
+	var outliers []string
+	for i, s := range samples {
+		if residMAD > 0 && math.Abs(resid[i]-residMedian) > 3*residMAD {
+			outliers = append(outliers, s.rel)
+		}
+	}
+
+	return driftStat{
+		Model:        model,
+		N:            n,
+		Median:       secDuration(median),
+		MAD:          secDuration(mad),
+		Min:          minD,
+		Max:          maxD,
+		SlopePPM:     slope * 1e6,
+		InterceptSec: intercept,
+		Outliers:     outliers,
+	}
+}
+
+func secDuration(sec float64) time.Duration { return time.Duration(sec * float64(time.Second)) }
+
+func medianFloat(xs []float64) float64 {
+	n := len(xs)
+	if n == 0 {
+		return 0
+	}
+	sort.Float64s(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
+
+func medianAbsDev(xs []float64, median float64) float64 {
+	dev := make([]float64, len(xs))
+	for i, x := range xs {
+		dev[i] = math.Abs(x - median)
+	}
+	return medianFloat(dev)
+}
+
+// theilSen fits y = slope*x + intercept robustly: slope is the median of
+// every pairwise slope (y_j-y_i)/(x_j-x_i), intercept the median of
+// y_i-slope*x_i. This tolerates a few mistagged samples far better than a
+// least-squares fit would.
+func theilSen(xs, ys []float64) (slope, intercept float64) {
+	n := len(xs)
+	if n == 0 {
+		return 0, 0
+	}
+	if n == 1 {
+		return 0, ys[0]
+	}
+
+	var slopes []float64
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			dx := xs[j] - xs[i]
+			if dx == 0 {
+				continue
+			}
+			slopes = append(slopes, (ys[j]-ys[i])/dx)
+		}
+	}
+	slope = medianFloat(slopes)
+
+	intercepts := make([]float64, n)
+	for i := range xs {
+		intercepts[i] = ys[i] - slope*xs[i]
+	}
+	intercept = medianFloat(intercepts)
+	return slope, intercept
+}
+
+func printDriftText(stats []driftStat) {
+	for _, s := range stats {
+		fmt.Printf("%s: n=%d median=%v mad=%v min=%v max=%v drift=%.2fppm intercept=%.2fs\n",
+			s.Model, s.N, s.Median, s.MAD, s.Min, s.Max, s.SlopePPM, s.InterceptSec)
+		for _, o := range s.Outliers {
+			fmt.Printf("  ! outlier %s\n", o)
+		}
+	}
+}
+
+// driftStatJSON is the wire shape for -report-format=json; durations are
+// expressed in seconds since JSON has no native duration type.
+type driftStatJSON struct {
+	Model        string   `json:"model"`
+	N            int      `json:"n"`
+	MedianSec    float64  `json:"medianSec"`
+	MADSec       float64  `json:"madSec"`
+	MinSec       float64  `json:"minSec"`
+	MaxSec       float64  `json:"maxSec"`
+	DriftPPM     float64  `json:"driftPPM"`
+	InterceptSec float64  `json:"interceptSec"`
+	Outliers     []string `json:"outliers,omitempty"`
+}
+
+func printDriftJSON(stats []driftStat) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, s := range stats {
+		enc.Encode(driftStatJSON{
+			Model:        s.Model,
+			N:            s.N,
+			MedianSec:    s.Median.Seconds(),
+			MADSec:       s.MAD.Seconds(),
+			MinSec:       s.Min.Seconds(),
+			MaxSec:       s.Max.Seconds(),
+			DriftPPM:     s.SlopePPM,
+			InterceptSec: s.InterceptSec,
+			Outliers:     s.Outliers,
+		})
+	}
+}
+
+func printDriftCSV(stats []driftStat) {
+	w := csv.NewWriter(os.Stdout)
+	defer w.Flush()
+	w.Write([]string{"model", "n", "medianSec", "madSec", "minSec", "maxSec", "driftPPM", "interceptSec", "outliers"})
+	for _, s := range stats {
+		w.Write([]string{
+			s.Model,
+			strconv.Itoa(s.N),
+			strconv.FormatFloat(s.Median.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(s.MAD.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(s.Min.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(s.Max.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(s.SlopePPM, 'f', 3, 64),
+			strconv.FormatFloat(s.InterceptSec, 'f', 3, 64),
+			strings.Join(s.Outliers, ";"),
+		})
+	}
+}
+
+// applyShifts rewrites DateTimeOriginal for every photo of each model in
+// byModel that has a detected median offset, subtracting that offset so
+// the camera's clock lines up with GPS time going forward.
+func applyShifts(byModel map[string][]*fileEntry, stats []driftStat) {
+	for _, s := range stats {
+		if s.Median == 0 {
+			continue
+		}
+		for _, e := range byModel[s.Model] {
+			shifted := e.et.DateTime.Add(-s.Median)
+			if *dryRun {
+				fmt.Printf("%s: DateTimeOriginal %v -> %v (dry run)\n", e.rel, e.et.DateTime, shifted)
+				continue
+			}
+			if err := exifwrite.OverwriteDateTimeOriginalFile(e.path, shifted); err != nil {
+				fmt.Printf("%s: apply-shift: %v\n", e.rel, err)
+			}
+		}
+	}
+}
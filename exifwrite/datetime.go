@@ -0,0 +1,124 @@
+package exifwrite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	tagExifIFDPointer   = 0x8769
+	tagDateTimeOriginal = 0x9003
+
+	typASCII = 2
+)
+
+// exifTimeLayout is the fixed-width layout EXIF uses for DateTime and
+// DateTimeOriginal: 19 characters plus a NUL, 20 bytes total.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// OverwriteDateTimeOriginalFile overwrites the DateTimeOriginal tag (EXIF
+// SubIFD tag 0x9003) of the JPEG file at path in place with t.
+func OverwriteDateTimeOriginalFile(path string, t time.Time) error {
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	patched, err := OverwriteDateTimeOriginal(orig, t)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".exifwrite.tmp"
+	if err := ioutil.WriteFile(tmp, patched, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// OverwriteDateTimeOriginal returns a copy of jpeg with its
+// DateTimeOriginal value replaced by t. Because EXIF stores that tag in a
+// fixed 20-byte ASCII field and t is formatted to the same width, the
+// replacement is always done in place; no other byte in the file moves.
+func OverwriteDateTimeOriginal(jpeg []byte, t time.Time) ([]byte, error) {
+	tiffStart, tiffEnd, err := findEXIFSegment(jpeg)
+	if err != nil {
+		return nil, err
+	}
+	tiff := append([]byte(nil), jpeg[tiffStart:tiffEnd]...)
+
+	bo, ifd0Off, err := tiffHeader(tiff)
+	if err != nil {
+		return nil, err
+	}
+
+	exifIFDOff, ok, err := findLongTagValue(tiff, bo, ifd0Off, tagExifIFDPointer)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("exifwrite: no Exif SubIFD to hold DateTimeOriginal")
+	}
+
+	valOff, count, err := findASCIITagValueOffset(tiff, bo, exifIFDOff, tagDateTimeOriginal)
+	if err != nil {
+		return nil, err
+	}
+
+	val := append([]byte(t.Format(exifTimeLayout)), 0)
+	if uint32(len(val)) > count {
+		return nil, fmt.Errorf("exifwrite: new DateTimeOriginal (%d bytes) does not fit existing tag (%d bytes)", len(val), count)
+	}
+	copy(tiff[valOff:], val)
+
+	out := make([]byte, 0, len(jpeg))
+	out = append(out, jpeg[:tiffStart]...)
+	out = append(out, tiff...)
+	out = append(out, jpeg[tiffEnd:]...)
+	return out, nil
+}
+
+// findLongTagValue scans the IFD at ifdOff for tag and returns its LONG
+// (4-byte) value.
+func findLongTagValue(tiff []byte, bo binary.ByteOrder, ifdOff uint32, tag uint16) (uint32, bool, error) {
+	numEntries := int(bo.Uint16(tiff[ifdOff : ifdOff+2]))
+	entriesOff := int(ifdOff) + 2
+	for i := 0; i < numEntries; i++ {
+		entOff := entriesOff + i*12
+		if entOff+12 > len(tiff) {
+			return 0, false, errors.New("exifwrite: truncated IFD")
+		}
+		if bo.Uint16(tiff[entOff:entOff+2]) == tag {
+			return bo.Uint32(tiff[entOff+8 : entOff+12]), true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// findASCIITagValueOffset scans the IFD at ifdOff for an ASCII-typed tag
+// and returns the offset of its value bytes within tiff and their count
+// (including the trailing NUL).
+func findASCIITagValueOffset(tiff []byte, bo binary.ByteOrder, ifdOff uint32, tag uint16) (valOff, count uint32, err error) {
+	numEntries := int(bo.Uint16(tiff[ifdOff : ifdOff+2]))
+	entriesOff := int(ifdOff) + 2
+	for i := 0; i < numEntries; i++ {
+		entOff := entriesOff + i*12
+		if entOff+12 > len(tiff) {
+			return 0, 0, errors.New("exifwrite: truncated IFD")
+		}
+		if bo.Uint16(tiff[entOff:entOff+2]) != tag {
+			continue
+		}
+		if bo.Uint16(tiff[entOff+2:entOff+4]) != typASCII {
+			return 0, 0, fmt.Errorf("exifwrite: tag %#04x is not ASCII-typed", tag)
+		}
+		count = bo.Uint32(tiff[entOff+4 : entOff+8])
+		if count <= 4 {
+			return uint32(entOff + 8), count, nil
+		}
+		return bo.Uint32(tiff[entOff+8 : entOff+12]), count, nil
+	}
+	return 0, 0, fmt.Errorf("exifwrite: tag %#04x not found", tag)
+}
@@ -0,0 +1,284 @@
+// Package exifwrite patches GPS tags into a JPEG file's existing EXIF
+// (APP1) segment in place. goexif, which the rest of this tool uses for
+// reading, is read-only, so writing back the small set of tags this tool
+// produces (inferred lat/lon and a corrected GPS timestamp) needs its own
+// minimal TIFF IFD patcher rather than a full EXIF encoder.
+package exifwrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// GPS holds the values to stamp into a file's GPS IFD.
+type GPS struct {
+	Lat, Lon float64
+	Time     time.Time // UTC
+}
+
+// ErrNoIFD0 is returned when a JPEG has no parseable EXIF/TIFF segment to
+// attach a GPS IFD to.
+var ErrNoIFD0 = errors.New("exifwrite: no EXIF segment found")
+
+// WriteGPSFile rewrites the GPS IFD of the JPEG file at path in place,
+// replacing any existing GPS tags with fix.
+func WriteGPSFile(path string, fix GPS) error {
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	patched, err := WriteGPS(orig, fix)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".exifwrite.tmp"
+	if err := ioutil.WriteFile(tmp, patched, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// markerSOI et al. are the JPEG segment markers this package needs to
+// walk a file's segment list far enough to find the EXIF APP1 segment.
+const (
+	markerSOI  = 0xd8
+	markerAPP1 = 0xe1
+	markerSOS  = 0xda
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// WriteGPS returns a copy of the JPEG image data with its GPS IFD
+// replaced (or added) to reflect fix.
+func WriteGPS(jpeg []byte, fix GPS) ([]byte, error) {
+	segStart, segEnd, err := findEXIFSegment(jpeg)
+	if err != nil {
+		return nil, err
+	}
+
+	tiff := jpeg[segStart:segEnd]
+	patched, err := patchTIFFGPS(tiff, fix)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(jpeg[:segStart-len(exifHeader)-4])
+	newSegLen := len(exifHeader) + len(patched) + 2
+	out.WriteByte(0xff)
+	out.WriteByte(markerAPP1)
+	binary.Write(&out, binary.BigEndian, uint16(newSegLen))
+	out.Write(exifHeader)
+	out.Write(patched)
+	out.Write(jpeg[segEnd:])
+	return out.Bytes(), nil
+}
+
+// findEXIFSegment walks jpeg's segment list and returns the start and end
+// offsets of the TIFF payload (i.e. right after the "Exif\0\0" header) of
+// the first EXIF APP1 segment found.
+func findEXIFSegment(jpeg []byte) (tiffStart, tiffEnd int, err error) {
+	if len(jpeg) < 4 || jpeg[0] != 0xff || jpeg[1] != markerSOI {
+		return 0, 0, errors.New("exifwrite: not a JPEG file")
+	}
+
+	off := 2
+	for off+4 <= len(jpeg) {
+		if jpeg[off] != 0xff {
+			return 0, 0, fmt.Errorf("exifwrite: malformed JPEG segment at offset %d", off)
+		}
+		marker := jpeg[off+1]
+		if marker == markerSOS {
+			break
+		}
+		segLen := int(binary.BigEndian.Uint16(jpeg[off+2 : off+4]))
+		segStart := off + 4
+		segEnd := off + 2 + segLen
+		if segEnd > len(jpeg) {
+			return 0, 0, errors.New("exifwrite: truncated JPEG segment")
+		}
+
+		if marker == markerAPP1 && bytes.HasPrefix(jpeg[segStart:segEnd], exifHeader) {
+			return segStart + len(exifHeader), segEnd, nil
+		}
+
+		off = segEnd
+	}
+
+	return 0, 0, ErrNoIFD0
+}
+
+// tiffHeader parses a TIFF byte order marker and returns the decoded byte
+// order and the offset of IFD0.
+func tiffHeader(tiff []byte) (bo binary.ByteOrder, ifd0Off uint32, err error) {
+	if len(tiff) < 8 {
+		return nil, 0, errors.New("exifwrite: TIFF header too short")
+	}
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, 0, errors.New("exifwrite: bad TIFF byte order marker")
+	}
+	if bo.Uint16(tiff[2:4]) != 42 {
+		return nil, 0, errors.New("exifwrite: bad TIFF magic")
+	}
+	ifd0Off = bo.Uint32(tiff[4:8])
+	if int(ifd0Off)+2 > len(tiff) {
+		return nil, 0, errors.New("exifwrite: bad IFD0 offset")
+	}
+	return bo, ifd0Off, nil
+}
+
+// patchTIFFGPS rewrites tiff's IFD0 GPS sub-IFD pointer (tag 0x8825) to
+// point at a freshly written GPS IFD appended to the end of the buffer,
+// leaving every other tag and byte untouched.
+//
+// This only supports the common case this tool produces: a single TIFF
+// IFD0 with no prior GPS IFD chained in a way that would leave orphaned
+// bytes; it is not a general-purpose TIFF editor.
+func patchTIFFGPS(tiff []byte, fix GPS) ([]byte, error) {
+	bo, ifd0Off, err := tiffHeader(tiff)
+	if err != nil {
+		return nil, err
+	}
+
+	numEntries := int(bo.Uint16(tiff[ifd0Off : ifd0Off+2]))
+	entriesOff := int(ifd0Off) + 2
+
+	out := append([]byte(nil), tiff...)
+	gpsIFDOff := uint32(len(out))
+	out = append(out, buildGPSIFD(bo, fix, gpsIFDOff)...)
+
+	const gpsIFDPointerTag = 0x8825
+	found := false
+	for i := 0; i < numEntries; i++ {
+		entOff := entriesOff + i*12
+		if entOff+12 > len(tiff) {
+			return nil, errors.New("exifwrite: truncated IFD0")
+		}
+		if bo.Uint16(tiff[entOff:entOff+2]) == gpsIFDPointerTag {
+			bo.PutUint32(out[entOff+8:entOff+12], gpsIFDOff)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("exifwrite: IFD0 has no GPS IFD pointer tag to patch; adding new IFD0 entries is not supported")
+	}
+
+	return out, nil
+}
+
+// buildGPSIFD encodes a minimal, self-contained GPS IFD (version, lat,
+// lon, and UTC date/time) with no "next IFD" link. The IFD is meant to be
+// placed at offset base within the TIFF payload; its value offsets are
+// relative to the TIFF header, as TIFF requires.
+func buildGPSIFD(bo binary.ByteOrder, fix GPS, base uint32) []byte {
+	type rat struct{ num, den uint32 }
+	toDMS := func(deg float64) [3]rat {
+		if deg < 0 {
+			deg = -deg
+		}
+		d := uint32(deg)
+		m := uint32((deg - float64(d)) * 60)
+		s := (deg - float64(d) - float64(m)/60) * 3600 * 1000
+		return [3]rat{{d, 1}, {m, 1}, {uint32(s), 1000}}
+	}
+	latDMS := toDMS(fix.Lat)
+	lonDMS := toDMS(fix.Lon)
+	latRef := byte('N')
+	if fix.Lat < 0 {
+		latRef = 'S'
+	}
+	lonRef := byte('E')
+	if fix.Lon < 0 {
+		lonRef = 'W'
+	}
+
+	const (
+		tagGPSVersionID = 0x0000
+		tagGPSLatRef    = 0x0001
+		tagGPSLat       = 0x0002
+		tagGPSLonRef    = 0x0003
+		tagGPSLon       = 0x0004
+		tagGPSTimeStamp = 0x0007
+		tagGPSDateStamp = 0x001d
+
+		typByte     = 1
+		typAscii    = 2
+		typRational = 5
+	)
+
+	var buf bytes.Buffer
+	const numEntries = 7
+	const ifdHeaderLen = 2 + numEntries*12 + 4
+	dataOff := base + uint32(ifdHeaderLen)
+
+	var entries bytes.Buffer
+	var data bytes.Buffer
+
+	putEntry := func(tag, typ uint16, count uint32, inlineOrOffset func() [4]byte) {
+		binary.Write(&entries, bo, tag)
+		binary.Write(&entries, bo, typ)
+		binary.Write(&entries, bo, count)
+		v := inlineOrOffset()
+		entries.Write(v[:])
+	}
+
+	putEntry(tagGPSVersionID, typByte, 4, func() [4]byte { return [4]byte{2, 3, 0, 0} })
+	putEntry(tagGPSLatRef, typAscii, 2, func() [4]byte { return [4]byte{latRef, 0, 0, 0} })
+	putEntry(tagGPSLat, typRational, 3, func() [4]byte {
+		off := dataOff + uint32(data.Len())
+		for _, r := range latDMS {
+			binary.Write(&data, bo, r.num)
+			binary.Write(&data, bo, r.den)
+		}
+		var b [4]byte
+		bo.PutUint32(b[:], off)
+		return b
+	})
+	putEntry(tagGPSLonRef, typAscii, 2, func() [4]byte { return [4]byte{lonRef, 0, 0, 0} })
+	putEntry(tagGPSLon, typRational, 3, func() [4]byte {
+		off := dataOff + uint32(data.Len())
+		for _, r := range lonDMS {
+			binary.Write(&data, bo, r.num)
+			binary.Write(&data, bo, r.den)
+		}
+		var b [4]byte
+		bo.PutUint32(b[:], off)
+		return b
+	})
+	putEntry(tagGPSTimeStamp, typRational, 3, func() [4]byte {
+		off := dataOff + uint32(data.Len())
+		h, m, s := fix.Time.Hour(), fix.Time.Minute(), fix.Time.Second()
+		for _, v := range [3]uint32{uint32(h), uint32(m), uint32(s)} {
+			binary.Write(&data, bo, v)
+			binary.Write(&data, bo, uint32(1))
+		}
+		var b [4]byte
+		bo.PutUint32(b[:], off)
+		return b
+	})
+	putEntry(tagGPSDateStamp, typAscii, 11, func() [4]byte {
+		off := dataOff + uint32(data.Len())
+		data.WriteString(fix.Time.Format("2006:01:02"))
+		data.WriteByte(0)
+		var b [4]byte
+		bo.PutUint32(b[:], off)
+		return b
+	})
+
+	binary.Write(&buf, bo, uint16(numEntries))
+	buf.Write(entries.Bytes())
+	binary.Write(&buf, bo, uint32(0)) // no next IFD
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
@@ -0,0 +1,118 @@
+package exifwrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// buildFixtureJPEG returns a minimal JPEG with a TIFF/EXIF APP1 segment
+// whose IFD0 holds a single GPS IFD pointer entry (tag 0x8825) with a
+// placeholder value, matching the only IFD0 shape patchTIFFGPS supports.
+func buildFixtureJPEG() []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("II")
+	binary.Write(&tiff, binary.LittleEndian, uint16(42))
+	binary.Write(&tiff, binary.LittleEndian, uint32(8)) // IFD0 offset
+
+	binary.Write(&tiff, binary.LittleEndian, uint16(1)) // 1 entry
+	binary.Write(&tiff, binary.LittleEndian, uint16(0x8825))
+	binary.Write(&tiff, binary.LittleEndian, uint16(4)) // LONG
+	binary.Write(&tiff, binary.LittleEndian, uint32(1))
+	binary.Write(&tiff, binary.LittleEndian, uint32(0)) // placeholder offset
+	binary.Write(&tiff, binary.LittleEndian, uint32(0)) // no next IFD
+
+	var app1 bytes.Buffer
+	app1.Write(exifHeader)
+	app1.Write(tiff.Bytes())
+
+	var jpeg bytes.Buffer
+	jpeg.Write([]byte{0xff, markerSOI})
+	jpeg.Write([]byte{0xff, markerAPP1})
+	binary.Write(&jpeg, binary.BigEndian, uint16(app1.Len()+2))
+	jpeg.Write(app1.Bytes())
+	jpeg.Write([]byte{0xff, 0xd9}) // EOI
+
+	return jpeg.Bytes()
+}
+
+// readGPSDMS reads the rational-triple value that the GPS IFD entry at
+// entOff within gps points at (an offset from the start of tiff, like
+// every TIFF value offset) and returns it as decimal degrees.
+func readGPSDMS(bo binary.ByteOrder, tiff, gps []byte, entOff int) float64 {
+	dataOff := bo.Uint32(gps[entOff+8 : entOff+12])
+	rat := func(i int) float64 {
+		off := int(dataOff) + i*8
+		num := bo.Uint32(tiff[off : off+4])
+		den := bo.Uint32(tiff[off+4 : off+8])
+		return float64(num) / float64(den)
+	}
+	return rat(0) + rat(1)/60 + rat(2)/3600
+}
+
+func TestWriteGPSRoundTrip(t *testing.T) {
+	fix := GPS{
+		Lat:  47.497912,
+		Lon:  19.040235,
+		Time: time.Date(2024, 5, 6, 12, 30, 45, 0, time.UTC),
+	}
+
+	patched, err := WriteGPS(buildFixtureJPEG(), fix)
+	if err != nil {
+		t.Fatalf("WriteGPS: %v", err)
+	}
+
+	segStart, segEnd, err := findEXIFSegment(patched)
+	if err != nil {
+		t.Fatalf("findEXIFSegment on patched JPEG: %v", err)
+	}
+	tiff := patched[segStart:segEnd]
+
+	bo, ifd0Off, err := tiffHeader(tiff)
+	if err != nil {
+		t.Fatalf("tiffHeader: %v", err)
+	}
+
+	numEntries := int(bo.Uint16(tiff[ifd0Off : ifd0Off+2]))
+	entriesOff := int(ifd0Off) + 2
+
+	var gpsOff uint32
+	var haveGPSOff bool
+	for i := 0; i < numEntries; i++ {
+		entOff := entriesOff + i*12
+		if bo.Uint16(tiff[entOff:entOff+2]) == 0x8825 {
+			gpsOff = bo.Uint32(tiff[entOff+8 : entOff+12])
+			haveGPSOff = true
+		}
+	}
+	if !haveGPSOff {
+		t.Fatal("patched IFD0 has no GPS IFD pointer entry")
+	}
+
+	gps := tiff[gpsOff:]
+	gpsEntries := int(bo.Uint16(gps[:2]))
+
+	var lat, lon float64
+	var haveLat, haveLon bool
+	for i := 0; i < gpsEntries; i++ {
+		entOff := 2 + i*12
+		switch bo.Uint16(gps[entOff : entOff+2]) {
+		case 0x0002: // GPSLatitude
+			lat, haveLat = readGPSDMS(bo, tiff, gps, entOff), true
+		case 0x0004: // GPSLongitude
+			lon, haveLon = readGPSDMS(bo, tiff, gps, entOff), true
+		}
+	}
+	if !haveLat || !haveLon {
+		t.Fatal("patched GPS IFD is missing GPSLatitude or GPSLongitude")
+	}
+
+	const eps = 1e-3
+	if d := lat - fix.Lat; d < -eps || d > eps {
+		t.Errorf("round-tripped lat = %v, want %v", lat, fix.Lat)
+	}
+	if d := lon - fix.Lon; d < -eps || d > eps {
+		t.Errorf("round-tripped lon = %v, want %v", lon, fix.Lon)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,35 +18,320 @@ import (
 	"camlistore.org/third_party/github.com/bradfitz/latlong"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
+
+	"github.com/tajtiattila/gpstimetest/exifwrite"
+	"github.com/tajtiattila/gpstimetest/gpxsync"
+)
+
+var (
+	trackFiles trackFlag
+	write      = flag.Bool("write", false, "with -track, patch inferred GPS tags back into the walked photo files")
+
+	driftReport  = flag.Bool("driftreport", false, "report per-model camera clock drift against GPSDateTime instead of per-file output")
+	reportFormat = flag.String("report-format", "text", "driftreport output format: text, json or csv")
+	applyShift   = flag.String("apply-shift", "", "with -driftreport, \"auto\" rewrites DateTimeOriginal using each model's detected median offset")
+	dryRun       = flag.Bool("dry-run", false, "with -apply-shift, report what would change without writing files")
+
+	format      = flag.String("format", "text", "per-file output format: text or json")
+	extraFields = flag.String("fields", "", "comma-separated extra EXIF fields to read into each record's Extra map, e.g. LensModel")
+
+	numWorkers = flag.Int("j", runtime.NumCPU(), "number of files to decode concurrently")
 )
 
+func init() {
+	flag.Var(&trackFiles, "track", "GPS track log (GPX, FIT or KML); may be repeated")
+}
+
+// trackFlag collects repeated -track flag occurrences.
+type trackFlag []string
+
+func (f *trackFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *trackFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// fileEntry is one walked file together with the exifTimes decoded from
+// it; entries are kept around after the walk so a track-based offset can
+// be solved jointly across the whole batch before anything is printed or
+// written back.
+type fileEntry struct {
+	rel, path string
+	et        exifTimes
+	err       error
+}
+
 func main() {
 	flag.Parse()
 
+	if *extraFields != "" {
+		for _, name := range strings.Split(*extraFields, ",") {
+			decoder.Extra = append(decoder.Extra, exif.FieldName(strings.TrimSpace(name)))
+		}
+	}
+
+	db, err := loadTracks(trackFiles)
+	if err != nil {
+		log.Fatalf("-track: %v", err)
+	}
+
+	var rels, paths []string
 	for _, root := range flag.Args() {
 		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 			if err != nil || info.IsDir() {
 				return nil
 			}
-
 			rel, _ := filepath.Rel(root, path)
+			rels = append(rels, rel)
+			paths = append(paths, path)
+			return nil
+		})
+	}
 
-			f, err := os.Open(path)
-			if err != nil {
-				fmt.Printf("%s open: %v\n", rel, err)
-				return nil
+	entries := decodeFiles(rels, paths, *numWorkers)
+
+	if db != nil {
+		inferTrackTimes(entries, db)
+	}
+
+	if *write {
+		writeInferred(entries)
+	}
+
+	if *driftReport {
+		runDriftReport(entries)
+		return
+	}
+
+	switch *format {
+	case "json":
+		printJSONRecords(entries)
+	default:
+		for _, e := range entries {
+			if e.err != nil {
+				fmt.Printf("%s %v\n", e.rel, e.err)
+				continue
 			}
-			defer f.Close()
+			fmt.Printf("%s: %v\n", e.rel, e.et.String())
+		}
+	}
+}
 
-			et, err := findExifTimes(f)
-			if err != nil {
-				fmt.Printf("%s exif: %v\n", rel, err)
-				return nil
+// decodeFiles decodes exifTimes for every file in paths (rels holds the
+// matching display names) using a pool of numWorkers goroutines, and
+// returns one *fileEntry per input in walk order. Walk order has to
+// survive the concurrency: downstream batch processing (inferTrackTimes,
+// runDriftReport) and -format=text/-format=json output both assume
+// entries[i] is the i'th file the walk found, regardless of which
+// worker happened to finish it first. Each result therefore carries its
+// walk index, and the single collector loop below writes it straight
+// into that slot rather than trusting the order results arrive in.
+func decodeFiles(rels, paths []string, numWorkers int) []*fileEntry {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+
+	entries := make([]*fileEntry, len(paths))
+	for i, rel := range rels {
+		entries[i] = &fileEntry{rel: rel, path: paths[i]}
+	}
+
+	type result struct {
+		idx int
+		et  exifTimes
+		err error
+	}
+
+	jobs := make(chan int)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				et, err := decodeFile(paths[idx])
+				results <- result{idx: idx, et: et, err: err}
 			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-			fmt.Printf("%s: %v\n", rel, et.String())
-			return nil
-		})
+	go func() {
+		for i := range paths {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for r := range results {
+		entries[r.idx].et = r.et
+		entries[r.idx].err = r.err
+	}
+
+	return entries
+}
+
+// decodeFile opens path, sniffs its container type, and extracts whatever
+// exifTimes it carries.
+func decodeFile(path string) (exifTimes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return exifTimes{}, fmt.Errorf("open: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return exifTimes{}, fmt.Errorf("stat: %v", err)
+	}
+
+	ts, err := sniffTimeSource(f)
+	if err != nil {
+		return exifTimes{}, fmt.Errorf("sniff: %v", err)
+	}
+
+	et, err := ts.FindTimes(f, info.Size())
+	if err != nil {
+		return exifTimes{}, fmt.Errorf("exif: %v", err)
+	}
+	return et, nil
+}
+
+// loadTracks merges every track log named by -track into a single
+// TrackDB. It returns a nil TrackDB, not an error, when no -track flags
+// were given.
+func loadTracks(files []string) (*gpxsync.TrackDB, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dbs := make([]*gpxsync.TrackDB, 0, len(files))
+	for _, fn := range files {
+		db, err := gpxsync.LoadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		dbs = append(dbs, db)
+	}
+	return gpxsync.Merge(dbs...), nil
+}
+
+// inferTrackTimes fills in Inferred on every entry whose photo has a
+// camera DateTime but no GPSDateTime of its own. It first solves one
+// camera-clock offset for the whole batch (see solveBatchOffset), then
+// applies it to look up each photo's position in db.
+func inferTrackTimes(entries []*fileEntry, db *gpxsync.TrackDB) {
+	offset, ok := solveBatchOffset(entries, db)
+	if !ok {
+		return
+	}
+	for _, e := range entries {
+		et := &e.et
+		if e.err != nil || et.DateTime.IsZero() || !et.GPSDateTime.IsZero() {
+			continue
+		}
+		utc := et.DateTime.Add(offset).UTC()
+		if s, ok := db.Interpolate(utc); ok {
+			et.Inferred = &InferredFix{UTC: utc, Lat: s.Lat, Lon: s.Lon}
+		}
+	}
+}
+
+// solveBatchOffset finds the single camera-clock offset (true UTC minus
+// camera DateTime) that best lines every photo in the batch up with db:
+// for each candidate offset it shifts every photo's DateTime by it and
+// sums how far each shifted time lands from the nearest sample db
+// actually recorded (db.Nearest's delta); the offset with the lowest
+// total residual is the joint solve. This works even when no photo in
+// the batch carries its own GPSDateTime at all, which is the case it has
+// to handle: a camera with no GPS of its own, geotagged purely from a
+// separate tracker log.
+//
+// The search is coarse-to-fine: a one-minute grid across the full
+// plausible offset range (derived from how far the batch's own DateTime
+// span sits from the track's span) finds the neighborhood, then a
+// one-second grid around that neighborhood refines it.
+func solveBatchOffset(entries []*fileEntry, db *gpxsync.TrackDB) (time.Duration, bool) {
+	var times []time.Time
+	for _, e := range entries {
+		if e.err == nil && !e.et.DateTime.IsZero() {
+			times = append(times, e.et.DateTime)
+		}
+	}
+	if len(times) == 0 {
+		return 0, false
+	}
+
+	start, end, ok := db.Span()
+	if !ok {
+		return 0, false
+	}
+
+	dtMin, dtMax := times[0], times[0]
+	for _, t := range times[1:] {
+		if t.Before(dtMin) {
+			dtMin = t
+		}
+		if t.After(dtMax) {
+			dtMax = t
+		}
+	}
+
+	// Candidate offsets range over whatever would put the batch's own
+	// DateTime span anywhere inside the track's recorded span, padded by
+	// half a day either way to tolerate a camera with the wrong
+	// timezone or a grossly wrong clock.
+	const pad = 12 * time.Hour
+	lo := start.Sub(dtMax) - pad
+	hi := end.Sub(dtMin) + pad
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	best := searchOffset(times, db, lo, hi, time.Minute)
+	best = searchOffset(times, db, best-time.Minute, best+time.Minute, time.Second)
+	return best, true
+}
+
+// searchOffset grid-searches [lo, hi] at the given step and returns the
+// offset with the lowest total residual, the sum of db.Nearest's time
+// delta for every time in times shifted by that offset.
+func searchOffset(times []time.Time, db *gpxsync.TrackDB, lo, hi, step time.Duration) time.Duration {
+	best := lo
+	bestResidual := time.Duration(math.MaxInt64)
+	for off := lo; off <= hi; off += step {
+		var residual time.Duration
+		for _, t := range times {
+			_, delta, ok := db.Nearest(t.Add(off))
+			if !ok {
+				residual = time.Duration(math.MaxInt64)
+				break
+			}
+			residual += delta
+		}
+		if residual < bestResidual {
+			bestResidual = residual
+			best = off
+		}
+	}
+	return best
+}
+
+// writeInferred patches each entry's inferred GPS fix back into its file.
+func writeInferred(entries []*fileEntry) {
+	for _, e := range entries {
+		if e.et.Inferred == nil {
+			continue
+		}
+		fix := exifwrite.GPS{Lat: e.et.Inferred.Lat, Lon: e.et.Inferred.Lon, Time: e.et.Inferred.UTC}
+		if err := exifwrite.WriteGPSFile(e.path, fix); err != nil {
+			fmt.Printf("%s write: %v\n", e.rel, err)
+		}
 	}
 }
 
@@ -55,6 +343,45 @@ type exifTimes struct {
 	GPSDateTime time.Time
 
 	HasGPSLoc bool
+	Lat, Lon  float64
+
+	// TZSource names where Corrected's timezone came from: the EXIF 2.31
+	// OffsetTimeOriginal tag when present (the precise source), a
+	// latlong zone lookup otherwise, the UTC offset of an MP4/MOV's
+	// com.apple.quicktime.creationdate ("quicktime") for video, or "none"
+	// when Corrected is zero.
+	TZSource string
+
+	// Extra holds any fields named in Decoder.Extra that were present.
+	Extra map[exif.FieldName]string
+
+	// Inferred holds a UTC time and position reconstructed from a -track
+	// log when the photo has no GPSDateTime of its own; see
+	// inferTrackTimes.
+	Inferred *InferredFix
+}
+
+// Decoder configures which additional EXIF fields findExifTimes reads
+// into exifTimes.Extra, beyond the Model/DateTime[Original]/GPS*/
+// OffsetTimeOriginal/SubSecTimeOriginal fields it always looks at.
+type Decoder struct {
+	Extra []exif.FieldName
+}
+
+var decoder Decoder
+
+const (
+	tzSourceOffsetTimeOriginal = "OffsetTimeOriginal"
+	tzSourceLatLong            = "latlong"
+	tzSourceQuickTime          = "quicktime"
+	tzSourceNone               = "none"
+)
+
+// InferredFix is a corrected UTC time and a geotag reconstructed from a
+// GPS track log for a photo whose camera had no GPS of its own.
+type InferredFix struct {
+	UTC      time.Time
+	Lat, Lon float64
 }
 
 func (t exifTimes) String() string {
@@ -66,6 +393,12 @@ func (t exifTimes) String() string {
 		return "! all times missing"
 	case !dt && gt:
 		return fmt.Sprintf("! %v only GPSDateTime=%v", t.Model, t.GPSDateTime)
+	case dt && !gt:
+		if t.Inferred != nil {
+			return fmt.Sprintf("%v DateTime=%v, Inferred UTC=%v lat=%v lon=%v",
+				t.Model, t.DateTime, t.Inferred.UTC, t.Inferred.Lat, t.Inferred.Lon)
+		}
+		return fmt.Sprintf("! %v no GPSDateTime, DateTime=%v", t.Model, t.DateTime)
 	case !ct && gt:
 		var msg string
 		if t.HasGPSLoc {
@@ -81,8 +414,29 @@ func (t exifTimes) String() string {
 	}
 }
 
-func findExifTimes(r io.Reader) (exifTimes, error) {
+// sniffLen bounds how much of a file findExifTimes reads: EXIF metadata
+// lives in the first few dozen KiB of any real-world JPEG, so reading
+// further almost never helps and is wasted I/O on a large photo library.
+const sniffLen = 256 * 1024
+
+// findExifTimes decodes exifTimes from the first sniffLen bytes of r,
+// falling back to reading all size bytes only when goexif reports that a
+// tag's value ran past what was read.
+func findExifTimes(r io.ReaderAt, size int64) (exifTimes, error) {
+	n := size
+	if n > sniffLen {
+		n = sniffLen
+	}
+	ret, err := decodeExifTimes(io.NewSectionReader(r, 0, n))
+	if err != nil && n < size && exif.IsShortReadTagValueError(err) {
+		return decodeExifTimes(io.NewSectionReader(r, 0, size))
+	}
+	return ret, err
+}
+
+func decodeExifTimes(r io.Reader) (exifTimes, error) {
 	var ret exifTimes
+	ret.TZSource = tzSourceNone
 
 	ex, err := exif.Decode(r)
 	if err != nil {
@@ -107,20 +461,111 @@ func findExifTimes(r io.Reader) (exifTimes, error) {
 		}
 		return ret, err
 	}
+	subSec := subSecDuration(ex, exif.FieldName("SubSecTimeOriginal"))
+	ret.DateTime = ret.DateTime.Add(subSec)
 
 	if ret.DateTime.Location() == time.Local {
 		if lat, long, err := ex.LatLong(); err == nil {
 			ret.HasGPSLoc = true
-			if loc := lookupLocation(latlong.LookupZoneName(lat, long)); loc != nil {
-				if t, err := exifDateTimeInLocation(ex, loc); err == nil {
-					ret.Corrected = t
-				}
+			ret.Lat, ret.Lon = lat, long
+		}
+
+		if loc, src, ok := exifLocation(ex, ret.Lat, ret.Lon, ret.HasGPSLoc); ok {
+			if t, err := exifDateTimeInLocation(ex, loc); err == nil {
+				ret.Corrected = t.Add(subSec)
+				ret.TZSource = src
 			}
 		}
 	}
+
+	readExtraFields(ex, &ret)
 	return ret, nil
 }
 
+// exifLocation picks the *time.Location to interpret DateTimeOriginal in,
+// preferring the EXIF 2.31 OffsetTimeOriginal tag (an explicit UTC
+// offset) over the latlong zone lookup the rest of this file has always
+// used, since an explicit offset can't be wrong the way a zone guessed
+// from a lat/long can.
+func exifLocation(x *exif.Exif, lat, long float64, hasLoc bool) (loc *time.Location, source string, ok bool) {
+	if tag, err := x.Get(exif.FieldName("OffsetTimeOriginal")); err == nil {
+		if s, err := tag.StringVal(); err == nil {
+			if off, err := parseOffsetTime(s); err == nil {
+				return time.FixedZone(s, off), tzSourceOffsetTimeOriginal, true
+			}
+		}
+	}
+
+	if hasLoc {
+		if loc := lookupLocation(latlong.LookupZoneName(lat, long)); loc != nil {
+			return loc, tzSourceLatLong, true
+		}
+	}
+	return nil, tzSourceNone, false
+}
+
+// parseOffsetTime parses an EXIF OffsetTimeOriginal value ("+02:00",
+// "-07:00", or "Z") into a UTC offset in seconds.
+func parseOffsetTime(s string) (int, error) {
+	if s == "Z" {
+		return 0, nil
+	}
+	if len(s) != 6 || (s[0] != '+' && s[0] != '-') {
+		return 0, fmt.Errorf("malformed OffsetTimeOriginal %q", s)
+	}
+	var h, m int
+	if _, err := fmt.Sscanf(s[1:], "%02d:%02d", &h, &m); err != nil {
+		return 0, fmt.Errorf("malformed OffsetTimeOriginal %q: %v", s, err)
+	}
+	off := h*3600 + m*60
+	if s[0] == '-' {
+		off = -off
+	}
+	return off, nil
+}
+
+// subSecDuration reads a SubSecTime[Original] tag (a string of decimal
+// digits giving the fraction of a second after the decimal point) and
+// returns it as a time.Duration, or 0 if absent or unparseable.
+func subSecDuration(x *exif.Exif, field exif.FieldName) time.Duration {
+	tag, err := x.Get(field)
+	if err != nil {
+		return 0
+	}
+	s, err := tag.StringVal()
+	if err != nil || s == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(n) * time.Second / time.Duration(pow10(len(s)))
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// readExtraFields populates ret.Extra with every field named in the
+// package-level decoder's Extra list that is actually present.
+func readExtraFields(x *exif.Exif, ret *exifTimes) {
+	for _, name := range decoder.Extra {
+		tag, err := x.Get(name)
+		if err != nil {
+			continue
+		}
+		if ret.Extra == nil {
+			ret.Extra = make(map[exif.FieldName]string)
+		}
+		ret.Extra[name] = tag.String()
+	}
+}
+
 func exifDateTime(x *exif.Exif) (time.Time, error) {
 	dt, err := exifGPSDateTime(x)
 	if err == nil {
@@ -174,8 +619,8 @@ func exifGPSDateTime(x *exif.Exif) (time.Time, error) {
 }
 
 // This is basically a copy of the exif.Exif.DateTime() method, except:
-//   * it takes a *time.Location to assume
-//   * the caller already assumes there's no timezone offset or GPS time
+//   - it takes a *time.Location to assume
+//   - the caller already assumes there's no timezone offset or GPS time
 //     in the EXIF, so any of that code can be ignored.
 func exifDateTimeInLocation(x *exif.Exif, loc *time.Location) (time.Time, error) {
 	tag, err := x.Get(exif.DateTimeOriginal)
@@ -0,0 +1,225 @@
+package gpxsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// LoadFIT reads position records out of a Garmin FIT activity file.
+//
+// This is not a general-purpose FIT decoder: it understands just enough of
+// the format (file header, definition messages, data messages, field
+// base types) to pull timestamp/position_lat/position_long/altitude out of
+// "record" messages (global message number 20), which is what every GPS
+// logger emits for a track. Developer fields and compressed timestamp
+// headers are not supported.
+func LoadFIT(r io.Reader) (*TrackDB, error) {
+	br := bufio.NewReader(r)
+
+	hdr, err := readFITHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	lr := io.LimitReader(br, int64(hdr.dataSize))
+	defs := make(map[byte]fitDef)
+	db := New()
+
+	for {
+		rec, err := readFITSample(lr, defs)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			db.Add(*rec)
+		}
+	}
+	db.Sort()
+	return db, nil
+}
+
+type fitHeader struct {
+	dataSize uint32
+}
+
+func readFITHeader(r io.Reader) (fitHeader, error) {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return fitHeader{}, err
+	}
+	size := hdr[0]
+	if string(hdr[8:12]) != ".FIT" {
+		return fitHeader{}, fmt.Errorf("gpxsync: not a FIT file")
+	}
+	dataSize := binary.LittleEndian.Uint32(hdr[4:8])
+	if size > 12 {
+		extra := make([]byte, size-12)
+		if _, err := io.ReadFull(r, extra); err != nil {
+			return fitHeader{}, err
+		}
+	}
+	return fitHeader{dataSize: dataSize}, nil
+}
+
+// fitDef is a parsed FIT definition message for one local message type.
+type fitDef struct {
+	globalNum uint16
+	bigEndian bool
+	fields    []fitField
+}
+
+type fitField struct {
+	num     byte
+	size    byte
+	baseNum byte // base type number, low 5 bits of the FIT base type byte
+}
+
+const (
+	fitMesgRecord       = 20
+	fitFieldTimestamp   = 253
+	fitFieldPositionLat = 0
+	fitFieldPositionLon = 1
+	fitFieldAltitude    = 2
+)
+
+// readFITSample reads and processes exactly one FIT record (definition or
+// data message), returning a Sample for record/position data messages.
+func readFITSample(r io.Reader, defs map[byte]fitDef) (*Sample, error) {
+	var recHdr [1]byte
+	if _, err := io.ReadFull(r, recHdr[:]); err != nil {
+		return nil, err
+	}
+	h := recHdr[0]
+	if h&0x80 != 0 {
+		return nil, fmt.Errorf("gpxsync: compressed timestamp headers are not supported")
+	}
+	local := h & 0x0f
+	isDef := h&0x40 != 0
+
+	if isDef {
+		def, err := readFITDef(r, h)
+		if err != nil {
+			return nil, err
+		}
+		defs[local] = def
+		return nil, nil
+	}
+
+	def, ok := defs[local]
+	if !ok {
+		return nil, fmt.Errorf("gpxsync: data message for undefined local type %d", local)
+	}
+	return readFITData(r, def)
+}
+
+func readFITDef(r io.Reader, h byte) (fitDef, error) {
+	var buf [5]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return fitDef{}, err
+	}
+	bigEndian := buf[1] != 0
+	bo := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		bo = binary.BigEndian
+	}
+	globalNum := bo.Uint16(buf[2:4])
+	numFields := int(buf[4])
+
+	fields := make([]fitField, numFields)
+	for i := 0; i < numFields; i++ {
+		var f [3]byte
+		if _, err := io.ReadFull(r, f[:]); err != nil {
+			return fitDef{}, err
+		}
+		fields[i] = fitField{num: f[0], size: f[1], baseNum: f[2] & 0x1f}
+	}
+
+	if h&0x20 != 0 { // developer data flag: skip developer field definitions
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return fitDef{}, err
+		}
+		skip := make([]byte, int(n[0])*3)
+		if _, err := io.ReadFull(r, skip); err != nil {
+			return fitDef{}, err
+		}
+	}
+
+	return fitDef{globalNum: globalNum, bigEndian: bigEndian, fields: fields}, nil
+}
+
+func readFITData(r io.Reader, def fitDef) (*Sample, error) {
+	bo := binary.ByteOrder(binary.LittleEndian)
+	if def.bigEndian {
+		bo = binary.BigEndian
+	}
+
+	var (
+		haveTime  bool
+		timestamp uint32
+		haveLat   bool
+		lat       int32
+		haveLon   bool
+		lon       int32
+		haveAlt   bool
+		alt       uint16
+	)
+
+	for _, f := range def.fields {
+		buf := make([]byte, f.size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if def.globalNum != fitMesgRecord {
+			continue
+		}
+		switch f.num {
+		case fitFieldTimestamp:
+			if f.size == 4 {
+				timestamp = bo.Uint32(buf)
+				haveTime = true
+			}
+		case fitFieldPositionLat:
+			if f.size == 4 {
+				lat = int32(bo.Uint32(buf))
+				haveLat = true
+			}
+		case fitFieldPositionLon:
+			if f.size == 4 {
+				lon = int32(bo.Uint32(buf))
+				haveLon = true
+			}
+		case fitFieldAltitude:
+			if f.size == 2 {
+				alt = bo.Uint16(buf)
+				haveAlt = true
+			}
+		}
+	}
+
+	if def.globalNum != fitMesgRecord || !haveTime || !haveLat || !haveLon {
+		return nil, nil
+	}
+
+	ele := math.NaN()
+	if haveAlt && alt != 0xffff {
+		ele = float64(alt)/5 - 500
+	}
+
+	return &Sample{
+		Time: fitEpoch.Add(time.Duration(timestamp) * time.Second),
+		Lat:  float64(lat) * (180.0 / (1 << 31)),
+		Lon:  float64(lon) * (180.0 / (1 << 31)),
+		Ele:  ele,
+	}, nil
+}
+
+// fitEpoch is the FIT timestamp epoch, 1989-12-31T00:00:00Z.
+var fitEpoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
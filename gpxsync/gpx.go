@@ -0,0 +1,52 @@
+package gpxsync
+
+import (
+	"encoding/xml"
+	"io"
+	"math"
+	"time"
+)
+
+// gpx mirrors the handful of GPX 1.1 elements this package needs; it is
+// deliberately not a full schema binding.
+type gpx struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele"`
+	Time string   `xml:"time"`
+}
+
+// LoadGPX reads a GPX 1.1 document's track points into a TrackDB.
+func LoadGPX(r io.Reader) (*TrackDB, error) {
+	var doc gpx
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	db := New()
+	for _, trk := range doc.Tracks {
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				t, err := time.Parse(time.RFC3339, p.Time)
+				if err != nil {
+					continue
+				}
+				ele := math.NaN()
+				if p.Ele != nil {
+					ele = *p.Ele
+				}
+				db.Add(Sample{Time: t.UTC(), Lat: p.Lat, Lon: p.Lon, Ele: ele})
+			}
+		}
+	}
+	db.Sort()
+	return db, nil
+}
@@ -0,0 +1,154 @@
+// Package gpxsync loads recorded GPS tracks (GPX, Garmin FIT, KML) into a
+// time-indexed structure that can be queried for the track's position at an
+// arbitrary UTC time. It is used to correct camera clocks and to geotag
+// photos that carry a wall-clock DateTime but no GPS fix of their own.
+package gpxsync
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sample is a single (time, position) fix read from a track log.
+type Sample struct {
+	Time time.Time // always UTC
+	Lat  float64
+	Lon  float64
+	Ele  float64 // meters above the reference ellipsoid/geoid; math.NaN() if absent
+}
+
+// TrackDB is a set of track samples indexed by time, merged from one or
+// more track logs and kept sorted for interpolation.
+type TrackDB struct {
+	samples []Sample // sorted by Time
+}
+
+// New returns an empty TrackDB.
+func New() *TrackDB {
+	return &TrackDB{}
+}
+
+// Add appends s to the database. Call Sort once all samples have been
+// added and before querying.
+func (db *TrackDB) Add(s Sample) {
+	db.samples = append(db.samples, s)
+}
+
+// Sort orders the accumulated samples by time. It is idempotent and cheap
+// to call again after merging another log.
+func (db *TrackDB) Sort() {
+	sort.Slice(db.samples, func(i, j int) bool {
+		return db.samples[i].Time.Before(db.samples[j].Time)
+	})
+}
+
+// Len reports the number of samples in the database.
+func (db *TrackDB) Len() int { return len(db.samples) }
+
+// Span returns the time range covered by the database. ok is false for an
+// empty database.
+func (db *TrackDB) Span() (start, end time.Time, ok bool) {
+	if len(db.samples) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return db.samples[0].Time, db.samples[len(db.samples)-1].Time, true
+}
+
+// Merge combines dbs into a single, time-sorted TrackDB.
+func Merge(dbs ...*TrackDB) *TrackDB {
+	out := New()
+	for _, db := range dbs {
+		out.samples = append(out.samples, db.samples...)
+	}
+	out.Sort()
+	return out
+}
+
+// Interpolate returns the track's estimated position at t, linearly
+// interpolating between the two samples bracketing it. ok is false when t
+// falls outside the track's time span.
+func (db *TrackDB) Interpolate(t time.Time) (s Sample, ok bool) {
+	n := len(db.samples)
+	if n == 0 {
+		return Sample{}, false
+	}
+	if t.Before(db.samples[0].Time) || t.After(db.samples[n-1].Time) {
+		return Sample{}, false
+	}
+	i := sort.Search(n, func(i int) bool { return !db.samples[i].Time.Before(t) })
+	if i == 0 {
+		return db.samples[0], true
+	}
+	if db.samples[i].Time.Equal(t) {
+		return db.samples[i], true
+	}
+	a, b := db.samples[i-1], db.samples[i]
+	span := b.Time.Sub(a.Time)
+	if span <= 0 {
+		return a, true
+	}
+	f := float64(t.Sub(a.Time)) / float64(span)
+	return Sample{
+		Time: t,
+		Lat:  a.Lat + f*(b.Lat-a.Lat),
+		Lon:  a.Lon + f*(b.Lon-a.Lon),
+		Ele:  interpEle(a.Ele, b.Ele, f),
+	}, true
+}
+
+func interpEle(a, b, f float64) float64 {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.NaN()
+	}
+	return a + f*(b-a)
+}
+
+// Nearest returns the sample closest in time to t and how far it is from
+// t. ok is false for an empty database.
+func (db *TrackDB) Nearest(t time.Time) (s Sample, delta time.Duration, ok bool) {
+	n := len(db.samples)
+	if n == 0 {
+		return Sample{}, 0, false
+	}
+	i := sort.Search(n, func(i int) bool { return !db.samples[i].Time.Before(t) })
+	best := i
+	if i == n {
+		best = n - 1
+	} else if i > 0 {
+		if t.Sub(db.samples[i-1].Time) < db.samples[i].Time.Sub(t) {
+			best = i - 1
+		}
+	}
+	s = db.samples[best]
+	delta = s.Time.Sub(t)
+	if delta < 0 {
+		delta = -delta
+	}
+	return s, delta, true
+}
+
+// LoadFile loads a track log, choosing a parser by file extension
+// (.gpx, .fit, .kml, case-insensitive).
+func LoadFile(path string) (*TrackDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".gpx":
+		return LoadGPX(f)
+	case ".fit":
+		return LoadFIT(f)
+	case ".kml":
+		return LoadKML(f)
+	default:
+		return nil, fmt.Errorf("gpxsync: unrecognized track file extension %q", ext)
+	}
+}
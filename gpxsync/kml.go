@@ -0,0 +1,75 @@
+package gpxsync
+
+import (
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kml binds the gx:Track extension (https://developers.google.com/kml/documentation/kmlreference#gxtrack)
+// that GPS loggers such as Google My Tracks and many dashcams use to embed
+// a time-indexed trace inside a Placemark.
+type kml struct {
+	Placemarks []struct {
+		Tracks []struct {
+			When  []string `xml:"when"`
+			Coord []string `xml:"coord"`
+		} `xml:"Track"`
+	} `xml:"Document>Placemark"`
+}
+
+// LoadKML reads gx:Track points from a KML document into a TrackDB.
+func LoadKML(r io.Reader) (*TrackDB, error) {
+	var doc kml
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	db := New()
+	for _, pm := range doc.Placemarks {
+		for _, trk := range pm.Tracks {
+			n := len(trk.When)
+			if len(trk.Coord) < n {
+				n = len(trk.Coord)
+			}
+			for i := 0; i < n; i++ {
+				t, err := time.Parse(time.RFC3339, trk.When[i])
+				if err != nil {
+					continue
+				}
+				lon, lat, ele, ok := parseKMLCoord(trk.Coord[i])
+				if !ok {
+					continue
+				}
+				db.Add(Sample{Time: t.UTC(), Lat: lat, Lon: lon, Ele: ele})
+			}
+		}
+	}
+	db.Sort()
+	return db, nil
+}
+
+// parseKMLCoord parses a gx:coord value, "lon lat [alt]".
+func parseKMLCoord(s string) (lon, lat, ele float64, ok bool) {
+	f := strings.Fields(s)
+	if len(f) < 2 {
+		return 0, 0, 0, false
+	}
+	var err error
+	if lon, err = strconv.ParseFloat(f[0], 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if lat, err = strconv.ParseFloat(f[1], 64); err != nil {
+		return 0, 0, 0, false
+	}
+	ele = math.NaN()
+	if len(f) >= 3 {
+		if v, err := strconv.ParseFloat(f[2], 64); err == nil {
+			ele = v
+		}
+	}
+	return lon, lat, ele, true
+}
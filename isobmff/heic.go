@@ -0,0 +1,196 @@
+package isobmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FindExifItem locates the embedded "Exif" item in a HEIC/HEIF file's
+// top-level "meta" box and returns the offset and length, within r, of
+// its raw TIFF payload (i.e. past the item's leading "exif tiff header
+// offset" field and the "Exif\0\0" marker it conventionally points past).
+// The returned range can be wrapped in an io.SectionReader and fed
+// straight to goexif.
+//
+// Only the common case HEIC encoders actually produce is supported: "infe"
+// entries of version 2 or 3, and an "iloc" box of version 0 or 1 with
+// 4-byte offsets, lengths and base offsets, no index field, and a single
+// extent for the Exif item. Anything else returns an error rather than a
+// guessed-at offset.
+func FindExifItem(r io.ReaderAt, size int64) (offset, length int64, err error) {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return 0, 0, err
+	}
+	meta, ok := findBox(top, "meta")
+	if !ok {
+		return 0, 0, errors.New("isobmff: no meta box")
+	}
+	children, err := readBoxes(r, meta.bodyStart+4, meta.bodyEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	iinf, ok := findBox(children, "iinf")
+	if !ok {
+		return 0, 0, errors.New("isobmff: no iinf box")
+	}
+	itemID, err := findExifItemID(r, iinf)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	iloc, ok := findBox(children, "iloc")
+	if !ok {
+		return 0, 0, errors.New("isobmff: no iloc box")
+	}
+	extOff, extLen, err := findItemExtent(r, iloc, itemID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// HEIF 8.1: an Exif item's payload starts with a 4-byte big-endian
+	// offset to the start of the actual TIFF header, conventionally 6
+	// (past a literal "Exif\0\0").
+	var lead [4]byte
+	if _, err := r.ReadAt(lead[:], extOff); err != nil {
+		return 0, 0, err
+	}
+	tiffHdrOff := int64(binary.BigEndian.Uint32(lead[:]))
+
+	start := extOff + 4 + tiffHdrOff
+	end := extOff + extLen
+	if start >= end {
+		return 0, 0, errors.New("isobmff: Exif item too short")
+	}
+	return start, end - start, nil
+}
+
+// findExifItemID scans an "iinf" box's "infe" children for the item
+// carrying item_type "Exif" and returns its item_id.
+func findExifItemID(r io.ReaderAt, iinf box) (uint32, error) {
+	buf, err := readFull(r, iinf)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < 6 {
+		return 0, errors.New("isobmff: truncated iinf box")
+	}
+	version := buf[0]
+	idx := 4
+	if version == 0 {
+		idx += 2 // entry_count (uint16)
+	} else {
+		idx += 4 // entry_count (uint32)
+	}
+
+	infes, err := readBoxes(r, iinf.bodyStart+int64(idx), iinf.bodyEnd)
+	if err != nil {
+		return 0, err
+	}
+	for _, infe := range infes {
+		if infe.typeString() != "infe" {
+			continue
+		}
+		id, itemType, err := parseInfe(r, infe)
+		if err != nil {
+			continue
+		}
+		if itemType == "Exif" {
+			return id, nil
+		}
+	}
+	return 0, errors.New("isobmff: no Exif item in iinf")
+}
+
+func parseInfe(r io.ReaderAt, infe box) (itemID uint32, itemType string, err error) {
+	buf, err := readFull(r, infe)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(buf) < 4 {
+		return 0, "", errors.New("isobmff: truncated infe box")
+	}
+	version := buf[0]
+	off := 4
+	switch version {
+	case 2:
+		if len(buf) < off+8 {
+			return 0, "", errors.New("isobmff: truncated infe box")
+		}
+		itemID = uint32(binary.BigEndian.Uint16(buf[off : off+2]))
+		itemType = string(buf[off+4 : off+8])
+	case 3:
+		if len(buf) < off+10 {
+			return 0, "", errors.New("isobmff: truncated infe box")
+		}
+		itemID = binary.BigEndian.Uint32(buf[off : off+4])
+		itemType = string(buf[off+6 : off+10])
+	default:
+		return 0, "", fmt.Errorf("isobmff: unsupported infe version %d", version)
+	}
+	return itemID, itemType, nil
+}
+
+// findItemExtent reads an "iloc" box's item location table and returns
+// the (offset, length) of the item's single extent.
+func findItemExtent(r io.ReaderAt, iloc box, wantID uint32) (offset, length int64, err error) {
+	buf, err := readFull(r, iloc)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(buf) < 8 {
+		return 0, 0, errors.New("isobmff: truncated iloc box")
+	}
+	version := buf[0]
+	if version > 1 {
+		return 0, 0, fmt.Errorf("isobmff: unsupported iloc version %d", version)
+	}
+
+	offsetSize := int(buf[4] >> 4)
+	lengthSize := int(buf[4] & 0xf)
+	baseOffsetSize := int(buf[5] >> 4)
+	indexSize := int(buf[5] & 0xf)
+	if offsetSize != 4 || lengthSize != 4 || baseOffsetSize != 4 || indexSize != 0 {
+		return 0, 0, errors.New("isobmff: unsupported iloc field sizes")
+	}
+
+	pos := 6
+	readUint16 := func() uint16 {
+		v := binary.BigEndian.Uint16(buf[pos : pos+2])
+		pos += 2
+		return v
+	}
+	readUint32 := func() uint32 {
+		v := binary.BigEndian.Uint32(buf[pos : pos+4])
+		pos += 4
+		return v
+	}
+
+	itemCount := int(readUint16())
+	for i := 0; i < itemCount; i++ {
+		itemID := uint32(readUint16())
+		if version == 1 {
+			pos += 2 // construction_method
+		}
+		pos += 2 // data_reference_index
+		baseOffset := int64(readUint32())
+		extentCount := int(readUint16())
+		if itemID == wantID && extentCount != 1 {
+			return 0, 0, fmt.Errorf("isobmff: item %d has %d extents, want 1", wantID, extentCount)
+		}
+		for e := 0; e < extentCount; e++ {
+			extOffset := int64(readUint32())
+			extLength := int64(readUint32())
+			if itemID == wantID && e == 0 {
+				offset, length = baseOffset+extOffset, extLength
+			}
+		}
+		if itemID == wantID {
+			return offset, length, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("isobmff: item %d not found in iloc", wantID)
+}
@@ -0,0 +1,317 @@
+// Package isobmff reads the handful of ISO-BMFF (MP4/MOV/HEIC/HEIF) boxes
+// this tool needs: the "moov"→"mvhd" movie header for a camera-reported
+// creation time, QuickTime's "moov"→"meta"→"keys"/"ilst" metadata for
+// com.apple.quicktime.creationdate and .location.ISO6709 (which iPhones
+// use to carry a timezone offset and GPS fix that EXIF's own tags can't
+// express), and (in heic.go) the "meta"→"iinf"/"iloc" item directory HEIC
+// uses to embed a plain EXIF blob.
+//
+// It is not a general-purpose ISO-BMFF/QuickTime library: only the boxes
+// listed above are understood, everything else is skipped over.
+package isobmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// box is one parsed ISO-BMFF box header.
+type box struct {
+	typ       [4]byte
+	bodyStart int64
+	bodyEnd   int64
+}
+
+func (b box) typeString() string { return string(b.typ[:]) }
+func (b box) size() int64        { return b.bodyEnd - b.bodyStart }
+
+// readBoxes parses the sequence of boxes covering [start, end) of r.
+func readBoxes(r io.ReaderAt, start, end int64) ([]box, error) {
+	var boxes []box
+	off := start
+	for off+8 <= end {
+		var hdr [8]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		headerLen := int64(8)
+
+		switch size {
+		case 0:
+			size = end - off
+		case 1:
+			var ext [8]byte
+			if _, err := r.ReadAt(ext[:], off+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(ext[:]))
+			headerLen = 16
+		}
+		if size < headerLen || off+size > end {
+			return nil, fmt.Errorf("isobmff: malformed box at offset %d", off)
+		}
+
+		var b box
+		copy(b.typ[:], hdr[4:8])
+		b.bodyStart = off + headerLen
+		b.bodyEnd = off + size
+		boxes = append(boxes, b)
+
+		off += size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typeString() == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+// readFull reads the whole body of b into memory; callers only use it for
+// boxes known to be small (a handful of metadata entries).
+func readFull(r io.ReaderAt, b box) ([]byte, error) {
+	buf := make([]byte, b.size())
+	if _, err := r.ReadAt(buf, b.bodyStart); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Info is the subset of MP4/MOV/QuickTime metadata this tool cares about.
+type Info struct {
+	// CreationTime is mvhd's movie creation time: the camera's own
+	// clock, with no timezone information, same as EXIF's DateTime.
+	CreationTime time.Time
+
+	// QuickTimeCreationDate is com.apple.quicktime.creationdate: an
+	// ISO-8601 timestamp that, unlike mvhd or EXIF, carries its own UTC
+	// offset.
+	QuickTimeCreationDate    time.Time
+	HasQuickTimeCreationDate bool
+
+	Lat, Lon    float64
+	HasLocation bool
+}
+
+// mvhd's time fields use the "Mac epoch", 1904-01-01T00:00:00Z.
+var mvhdEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ReadInfo reads Info out of the MP4/MOV/QuickTime container spanning
+// exactly size bytes of r.
+func ReadInfo(r io.ReaderAt, size int64) (Info, error) {
+	var info Info
+
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return Info{}, err
+	}
+	moov, ok := findBox(top, "moov")
+	if !ok {
+		return Info{}, errors.New("isobmff: no moov box")
+	}
+	moovChildren, err := readBoxes(r, moov.bodyStart, moov.bodyEnd)
+	if err != nil {
+		return Info{}, err
+	}
+
+	if mvhd, ok := findBox(moovChildren, "mvhd"); ok {
+		t, err := readMVHDCreationTime(r, mvhd)
+		if err == nil {
+			info.CreationTime = t
+		}
+	}
+
+	if meta, ok := findBox(moovChildren, "meta"); ok {
+		if err := readQuickTimeMeta(r, meta, &info); err != nil {
+			return Info{}, err
+		}
+	}
+
+	return info, nil
+}
+
+func readMVHDCreationTime(r io.ReaderAt, mvhd box) (time.Time, error) {
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], mvhd.bodyStart); err != nil {
+		return time.Time{}, err
+	}
+	version := hdr[0]
+
+	var secs uint64
+	switch version {
+	case 0:
+		var buf [4]byte
+		if _, err := r.ReadAt(buf[:], mvhd.bodyStart+4); err != nil {
+			return time.Time{}, err
+		}
+		secs = uint64(binary.BigEndian.Uint32(buf[:]))
+	case 1:
+		var buf [8]byte
+		if _, err := r.ReadAt(buf[:], mvhd.bodyStart+4); err != nil {
+			return time.Time{}, err
+		}
+		secs = binary.BigEndian.Uint64(buf[:])
+	default:
+		return time.Time{}, fmt.Errorf("isobmff: unsupported mvhd version %d", version)
+	}
+
+	// mvhd carries no timezone, so treat it the same way goexif treats a
+	// bare EXIF DateTime: as a reading of the local wall clock.
+	t := mvhdEpoch.Add(time.Duration(secs) * time.Second)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+}
+
+// readQuickTimeMeta reads moov/meta's "keys" and "ilst" children, looking
+// for com.apple.quicktime.creationdate and
+// com.apple.quicktime.location.ISO6709.
+func readQuickTimeMeta(r io.ReaderAt, meta box, info *Info) error {
+	// meta is a full box: 4 bytes of version/flags precede its children.
+	children, err := readBoxes(r, meta.bodyStart+4, meta.bodyEnd)
+	if err != nil {
+		return err
+	}
+
+	keysBox, ok := findBox(children, "keys")
+	if !ok {
+		return nil
+	}
+	ilstBox, ok := findBox(children, "ilst")
+	if !ok {
+		return nil
+	}
+
+	keys, err := readKeys(r, keysBox)
+	if err != nil {
+		return err
+	}
+
+	items, err := readBoxes(r, ilstBox.bodyStart, ilstBox.bodyEnd)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		// Inside "ilst", a child box's 4-byte "type" field is really a
+		// 1-based index into keys, not a fourcc.
+		idx := int(binary.BigEndian.Uint32(item.typ[:]))
+		if idx < 1 || idx > len(keys) {
+			continue
+		}
+		val, err := readItemDataString(r, item)
+		if err != nil || val == "" {
+			continue
+		}
+		switch keys[idx-1] {
+		case "com.apple.quicktime.creationdate":
+			if t, err := time.Parse("2006-01-02T15:04:05-0700", val); err == nil {
+				info.QuickTimeCreationDate = t
+				info.HasQuickTimeCreationDate = true
+			}
+		case "com.apple.quicktime.location.ISO6709":
+			if lat, lon, ok := parseISO6709(val); ok {
+				info.Lat, info.Lon = lat, lon
+				info.HasLocation = true
+			}
+		}
+	}
+	return nil
+}
+
+// readKeys reads a QuickTime "keys" full box into an ordered list of key
+// names (1-based index i is keys[i-1]).
+func readKeys(r io.ReaderAt, keysBox box) ([]string, error) {
+	buf, err := readFull(r, keysBox)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 8 {
+		return nil, errors.New("isobmff: truncated keys box")
+	}
+	count := binary.BigEndian.Uint32(buf[4:8])
+	keys := make([]string, 0, count)
+	off := 8
+	for i := uint32(0); i < count; i++ {
+		if off+8 > len(buf) {
+			return nil, errors.New("isobmff: truncated keys entry")
+		}
+		entrySize := int(binary.BigEndian.Uint32(buf[off : off+4]))
+		if entrySize < 8 || off+entrySize > len(buf) {
+			return nil, errors.New("isobmff: malformed keys entry")
+		}
+		keys = append(keys, string(buf[off+8:off+entrySize]))
+		off += entrySize
+	}
+	return keys, nil
+}
+
+// readItemDataString reads an "ilst" item's "data" child and returns its
+// payload as a string (the only data type this tool needs).
+func readItemDataString(r io.ReaderAt, item box) (string, error) {
+	children, err := readBoxes(r, item.bodyStart, item.bodyEnd)
+	if err != nil {
+		return "", err
+	}
+	data, ok := findBox(children, "data")
+	if !ok {
+		return "", nil
+	}
+	buf, err := readFull(r, data)
+	if err != nil {
+		return "", err
+	}
+	if len(buf) < 8 {
+		return "", nil
+	}
+	return string(buf[8:]), nil
+}
+
+// parseISO6709 parses the subset of ISO 6709 QuickTime uses for
+// "+DD.DDDD+DDD.DDDD+AAA.AAA/" style GPS coordinates.
+func parseISO6709(s string) (lat, lon float64, ok bool) {
+	s = strings.TrimSuffix(s, "/")
+
+	// Find the second sign character, which starts the longitude field.
+	second := -1
+	for i := 1; i < len(s); i++ {
+		if s[i] == '+' || s[i] == '-' {
+			second = i
+			break
+		}
+	}
+	if second < 0 {
+		return 0, 0, false
+	}
+
+	// A third sign character, if present, starts an altitude field we
+	// don't need.
+	end := len(s)
+	for i := second + 1; i < len(s); i++ {
+		if s[i] == '+' || s[i] == '-' {
+			end = i
+			break
+		}
+	}
+
+	latF, err := strconv.ParseFloat(s[:second], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	lonF, err := strconv.ParseFloat(s[second:end], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if math.IsNaN(latF) || math.IsNaN(lonF) {
+		return 0, 0, false
+	}
+	return latF, lonF, true
+}
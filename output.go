@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// jsonRecord is the -format=json wire shape for one file: a flattened,
+// machine-readable view of exifTimes suitable for piping into other
+// tools.
+type jsonRecord struct {
+	Path        string  `json:"path"`
+	Error       string  `json:"error,omitempty"`
+	Model       string  `json:"model,omitempty"`
+	DateTime    string  `json:"dateTime,omitempty"`
+	DateTimeUTC string  `json:"dateTimeUTC,omitempty"`
+	GPSDateTime string  `json:"gpsDateTime,omitempty"`
+	DeltaSec    float64 `json:"deltaSec,omitempty"`
+	TZSource    string  `json:"tzSource,omitempty"`
+	Lat         float64 `json:"lat,omitempty"`
+	Lon         float64 `json:"lon,omitempty"`
+
+	Extra map[string]string `json:"extra,omitempty"`
+}
+
+const jsonTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+func printJSONRecords(entries []*fileEntry) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		enc.Encode(toJSONRecord(e))
+	}
+}
+
+func toJSONRecord(e *fileEntry) jsonRecord {
+	rec := jsonRecord{Path: e.rel}
+	if e.err != nil {
+		rec.Error = e.err.Error()
+		return rec
+	}
+
+	et := e.et
+	rec.Model = et.Model
+	rec.TZSource = et.TZSource
+	rec.Lat, rec.Lon = et.Lat, et.Lon
+
+	if !et.DateTime.IsZero() {
+		rec.DateTime = et.DateTime.Format(jsonTimeLayout)
+	}
+	if !et.Corrected.IsZero() {
+		rec.DateTimeUTC = et.Corrected.UTC().Format(jsonTimeLayout)
+	}
+	if !et.GPSDateTime.IsZero() {
+		rec.GPSDateTime = et.GPSDateTime.Format(jsonTimeLayout)
+	}
+	if !et.Corrected.IsZero() && !et.GPSDateTime.IsZero() {
+		rec.DeltaSec = et.Corrected.Sub(et.GPSDateTime).Seconds()
+	}
+
+	if len(et.Extra) > 0 {
+		rec.Extra = make(map[string]string, len(et.Extra))
+		for name, val := range et.Extra {
+			rec.Extra[string(name)] = val
+		}
+	}
+	return rec
+}
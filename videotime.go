@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tajtiattila/gpstimetest/isobmff"
+)
+
+// TimeSource extracts whatever capture-time and GPS metadata a file
+// carries. Implementations exist for JPEG/TIFF (and HEIC, which embeds a
+// plain EXIF item) and for MP4/MOV ISO-BMFF containers; main dispatches
+// between them by sniffing each file's header rather than trusting its
+// extension.
+type TimeSource interface {
+	FindTimes(r io.ReaderAt, size int64) (exifTimes, error)
+}
+
+type jpegTimeSource struct{}
+
+func (jpegTimeSource) FindTimes(r io.ReaderAt, size int64) (exifTimes, error) {
+	return findExifTimes(r, size)
+}
+
+type heicTimeSource struct{}
+
+func (heicTimeSource) FindTimes(r io.ReaderAt, size int64) (exifTimes, error) {
+	off, length, err := isobmff.FindExifItem(r, size)
+	if err != nil {
+		return exifTimes{}, fmt.Errorf("heic: %v", err)
+	}
+	return findExifTimes(io.NewSectionReader(r, off, length), length)
+}
+
+type isobmffTimeSource struct{}
+
+func (isobmffTimeSource) FindTimes(r io.ReaderAt, size int64) (exifTimes, error) {
+	return findVideoTimes(r, size)
+}
+
+// sniffTimeSource picks a TimeSource by looking at a file's first bytes,
+// not its extension: JPEG/TIFF magic selects the EXIF path, an ISO-BMFF
+// "ftyp" box selects either the HEIC or the generic MP4/MOV path
+// depending on its major brand.
+func sniffTimeSource(r io.ReaderAt) (TimeSource, error) {
+	var hdr [12]byte
+	n, err := r.ReadAt(hdr[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b := hdr[:n]
+
+	switch {
+	case len(b) >= 2 && b[0] == 0xff && b[1] == 0xd8:
+		return jpegTimeSource{}, nil
+	case len(b) >= 4 && (string(b[:4]) == "II*\x00" || string(b[:4]) == "MM\x00*"):
+		return jpegTimeSource{}, nil
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		if isHEICBrand(string(b[8:12])) {
+			return heicTimeSource{}, nil
+		}
+		return isobmffTimeSource{}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized file type")
+	}
+}
+
+func isHEICBrand(brand string) bool {
+	switch brand {
+	case "heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs", "mif1", "msf1":
+		return true
+	}
+	return false
+}
+
+// findVideoTimes extracts exifTimes-shaped capture time and GPS data from
+// an MP4/MOV container. It mirrors findExifTimes' JPEG logic: mvhd's
+// creation time plays the role of the camera-reported DateTime (no
+// timezone of its own, so treated as a bare local reading), and, when
+// present, com.apple.quicktime.creationdate plays the role of
+// GPSDateTime: a trustworthy UTC instant the DateTime reading is checked
+// against. Corrected reinterprets the same wall-clock reading in the
+// timezone creationdate reveals, exactly as the EXIF path reinterprets it
+// in the zone a lat/long lookup reveals.
+func findVideoTimes(r io.ReaderAt, size int64) (exifTimes, error) {
+	var ret exifTimes
+	ret.TZSource = tzSourceNone
+
+	info, err := isobmff.ReadInfo(r, size)
+	if err != nil {
+		return ret, err
+	}
+
+	ret.DateTime = info.CreationTime
+	ret.HasGPSLoc = info.HasLocation
+	if ret.HasGPSLoc {
+		ret.Lat, ret.Lon = info.Lat, info.Lon
+	}
+
+	if !info.HasQuickTimeCreationDate {
+		return ret, nil
+	}
+	ret.GPSDateTime = info.QuickTimeCreationDate.UTC()
+
+	if ret.DateTime.IsZero() {
+		return ret, nil
+	}
+	_, offset := info.QuickTimeCreationDate.Zone()
+	loc := time.FixedZone(fmt.Sprintf("UTC%+03d:%02d", offset/3600, (offset/60)%60), offset)
+	ret.Corrected = time.Date(
+		ret.DateTime.Year(), ret.DateTime.Month(), ret.DateTime.Day(),
+		ret.DateTime.Hour(), ret.DateTime.Minute(), ret.DateTime.Second(), 0,
+		loc)
+	ret.TZSource = tzSourceQuickTime
+
+	return ret, nil
+}